@@ -0,0 +1,25 @@
+package app
+
+import "context"
+
+// MessageBus lets a Room fan its messages out to other app instances
+// hosting the same logical Room behind a load balancer, and receive
+// theirs in turn. Without a MessageBus, a Room lives only in the memory
+// of the process that created it.
+type MessageBus interface {
+	// Publish sends msg to every node subscribed to roomID, including
+	// this one.
+	Publish(ctx context.Context, roomID RoomID, msg *outgoingMessage) error
+	// Subscribe begins receiving messages published to roomID from any
+	// node. Callers must Close the returned BusSubscription when done.
+	Subscribe(ctx context.Context, roomID RoomID) (BusSubscription, error)
+}
+
+// BusSubscription is a live subscription to a MessageBus topic.
+type BusSubscription interface {
+	// Messages yields messages published to the subscribed topic. It is
+	// closed once the subscription ends.
+	Messages() <-chan *outgoingMessage
+	// Close ends the subscription.
+	Close() error
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// commandPrefix marks an incomingMessage's content as a slash-command
+// rather than chat content to be broadcast as-is.
+const commandPrefix = "/"
+
+// dispatchCommand parses msg's content as a slash-command and, if msg.from
+// is an op in r, executes it. It reports whether content was a command at
+// all, so the caller knows not to also broadcast it as chat - a command
+// that was refused for lack of privilege is still "handled" (silently
+// dropped), not broadcast to the room as text.
+//
+// Only messages with the zero msgType (ordinary chat from a Client) are
+// sniffed for a command prefix. System-generated incomingMessages such as
+// the Topic announcement setTopic broadcasts carry a non-zero msgType
+// specifically so they can't be misparsed as a command (or re-trigger one)
+// when relayed back through this same r.broadcast path.
+func dispatchCommand(r *Room, msg *incomingMessage) (handled bool) {
+	if msg.msgType != 0 {
+		return false
+	}
+
+	content := msg.content
+	from := msg.from
+
+	if !strings.HasPrefix(content, commandPrefix) {
+		return false
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(content, commandPrefix))
+	if len(fields) == 0 {
+		return true
+	}
+	name, args := fields[0], fields[1:]
+
+	member := r.clients[from]
+	if member == nil || !member.IsOp {
+		return true
+	}
+
+	switch name {
+	case "mute":
+		if !withMember(r, args, func(m *Member) { m.SetMuted(true) }) {
+			notifyCommandFailed(r, from, name, args)
+		}
+	case "unmute":
+		if !withMember(r, args, func(m *Member) { m.SetMuted(false) }) {
+			notifyCommandFailed(r, from, name, args)
+		}
+	case "op":
+		if !withMember(r, args, func(m *Member) { m.IsOp = true }) {
+			notifyCommandFailed(r, from, name, args)
+		}
+	case "kick":
+		// route through r.unregister, same as a normal disconnect, so the
+		// room still gets the Left broadcast and the room-empty exit
+		// check in unregister() still runs
+		found := withMember(r, args, func(m *Member) {
+			client := m.Client
+			go func() { r.unregister <- client }()
+		})
+		if !found {
+			notifyCommandFailed(r, from, name, args)
+		}
+	case "topic":
+		setTopic(r, from, strings.Join(args, " "))
+	}
+
+	return true
+}
+
+// withMember looks up the Member whose Client ID is args[0] and, if found,
+// applies fn to it, reporting whether such a Member was found. A Member is
+// only found if it's registered with this Room on this node: a federated
+// Room (see MessageBus) spans multiple nodes, and a nick connected
+// elsewhere is invisible here.
+func withMember(r *Room, args []string, fn func(*Member)) bool {
+	if len(args) == 0 {
+		return false
+	}
+	nick := args[0]
+	for c, m := range r.clients {
+		if string(c.id) == nick {
+			fn(m)
+			return true
+		}
+	}
+	return false
+}
+
+// notifyCommandFailed tells from that its command did not find a target,
+// rather than letting it silently no-op - most commonly because the named
+// member is connected to a different node of a federated Room.
+func notifyCommandFailed(r *Room, from *Client, name string, args []string) {
+	nick := ""
+	if len(args) > 0 {
+		nick = args[0]
+	}
+	from.Send(&outgoingMessage{
+		Room:    r.id,
+		MsgType: messageTypes.CommandError,
+		Content: fmt.Sprintf("/%s %s: no such member in this room", name, nick),
+		SentAt:  time.Now(),
+	})
+}
+
+// setTopic updates the Room's topic and announces the change to every
+// Member.
+func setTopic(r *Room, from *Client, topic string) {
+	r.topic = topic
+	go func() {
+		r.broadcast <- &incomingMessage{from: from, msgType: messageTypes.Topic, content: topic, sendBackToFrom: true}
+	}()
+}
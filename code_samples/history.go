@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"sync"
+)
+
+// HistoryStore persists broadcast messages for a Room so that Clients who
+// join late can be replayed recent context. Implementations must be safe
+// for concurrent use.
+type HistoryStore interface {
+	// NextMessageID returns the next ID to stamp on a message broadcast in
+	// roomID. Implementations must hand out strictly increasing IDs across
+	// every node sharing this HistoryStore, since a federated Room (see
+	// MessageBus) has more than one node appending to the same log and
+	// History's beforeID pagination depends on the log staying ID-ordered.
+	NextMessageID(ctx context.Context, roomID RoomID) (uint64, error)
+	// Append records msg as having been broadcast in roomID.
+	Append(ctx context.Context, roomID RoomID, msg *outgoingMessage) error
+	// History returns up to limit messages broadcast in roomID, oldest
+	// first, so callers can replay them in the order they originally
+	// happened. If beforeID is non-zero, only messages with an ID less
+	// than beforeID are returned, enabling pagination backwards through
+	// the log. A limit of zero or less returns every retained message.
+	History(ctx context.Context, roomID RoomID, limit int, beforeID uint64) ([]*outgoingMessage, error)
+}
+
+// memoryHistoryStore is the default HistoryStore: an in-process, in-memory
+// log. It does not survive process restarts and does not share state
+// across RoomService instances; use a Redis-backed HistoryStore for that.
+// Since it's confined to a single process, its message IDs are only
+// strictly increasing within that process - fine for an unfederated Room,
+// but NOT safe to share across nodes of a federated one.
+type memoryHistoryStore struct {
+	mu      sync.Mutex
+	logs    map[RoomID][]*outgoingMessage
+	nextIDs map[RoomID]uint64
+}
+
+// NewMemoryHistoryStore returns a HistoryStore backed by an in-process map.
+func NewMemoryHistoryStore() HistoryStore {
+	return &memoryHistoryStore{
+		logs:    make(map[RoomID][]*outgoingMessage),
+		nextIDs: make(map[RoomID]uint64),
+	}
+}
+
+func (s *memoryHistoryStore) NextMessageID(ctx context.Context, roomID RoomID) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextIDs[roomID]++
+	return s.nextIDs[roomID], nil
+}
+
+func (s *memoryHistoryStore) Append(ctx context.Context, roomID RoomID, msg *outgoingMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log := append(s.logs[roomID], msg)
+	if len(log) > maxHistoryLen {
+		log = log[len(log)-maxHistoryLen:]
+	}
+	s.logs[roomID] = log
+	return nil
+}
+
+func (s *memoryHistoryStore) History(ctx context.Context, roomID RoomID, limit int, beforeID uint64) ([]*outgoingMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log := s.logs[roomID]
+
+	// narrow to messages strictly before beforeID, if given
+	if beforeID > 0 {
+		end := len(log)
+		for end > 0 && log[end-1].ID >= beforeID {
+			end--
+		}
+		log = log[:end]
+	}
+
+	if limit <= 0 || limit > len(log) {
+		limit = len(log)
+	}
+
+	out := make([]*outgoingMessage, limit)
+	copy(out, log[len(log)-limit:])
+	return out, nil
+}
@@ -0,0 +1,37 @@
+package app
+
+import "sync"
+
+// Member wraps a Client with the per-room metadata a Room needs to
+// moderate it: whether it can run op-only Commands, and whether its
+// messages are currently suppressed from broadcast.
+type Member struct {
+	*Client
+
+	// IsOp is only ever read and written from the Room's Run goroutine,
+	// so it needs no lock.
+	IsOp bool
+
+	mu      sync.Mutex
+	isMuted bool
+}
+
+// newMember wraps client as a Member with no special privileges.
+func newMember(client *Client) *Member {
+	return &Member{Client: client}
+}
+
+// Muted reports whether m's messages are currently suppressed from
+// broadcast.
+func (m *Member) Muted() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isMuted
+}
+
+// SetMuted sets whether m's messages are suppressed from broadcast.
+func (m *Member) SetMuted(muted bool) {
+	m.mu.Lock()
+	m.isMuted = muted
+	m.mu.Unlock()
+}
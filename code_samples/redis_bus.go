@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// busTopic is the Redis Pub/Sub channel a Room's messages are published to.
+func busTopic(roomID RoomID) string {
+	return fmt.Sprintf("room:%s", roomID)
+}
+
+// redisMessageBus is a MessageBus backed by Redis Pub/Sub.
+type redisMessageBus struct {
+	client *redis.Client
+}
+
+// NewRedisMessageBus returns a MessageBus backed by client.
+func NewRedisMessageBus(client *redis.Client) MessageBus {
+	return &redisMessageBus{client: client}
+}
+
+func (b *redisMessageBus) Publish(ctx context.Context, roomID RoomID, msg *outgoingMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "redisMessageBus: marshal outgoingMessage")
+	}
+	return errors.Wrap(b.client.Publish(ctx, busTopic(roomID), payload).Err(), "redisMessageBus: publish")
+}
+
+func (b *redisMessageBus) Subscribe(ctx context.Context, roomID RoomID) (BusSubscription, error) {
+	pubsub := b.client.Subscribe(ctx, busTopic(roomID))
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return nil, errors.Wrap(err, "redisMessageBus: subscribe")
+	}
+
+	sub := &redisBusSubscription{pubsub: pubsub, messages: make(chan *outgoingMessage)}
+	go sub.relay()
+	return sub, nil
+}
+
+// redisBusSubscription relays Redis Pub/Sub payloads onto a typed channel,
+// so callers don't need to know about the wire format.
+type redisBusSubscription struct {
+	pubsub   *redis.PubSub
+	messages chan *outgoingMessage
+}
+
+func (s *redisBusSubscription) relay() {
+	defer close(s.messages)
+	for raw := range s.pubsub.Channel() {
+		msg := &outgoingMessage{}
+		if err := json.Unmarshal([]byte(raw.Payload), msg); err != nil {
+			log.Printf("MessageBusError: failed to unmarshal outgoingMessage from bus.\nError: %s", err)
+			continue
+		}
+		s.messages <- msg
+	}
+}
+
+func (s *redisBusSubscription) Messages() <-chan *outgoingMessage {
+	return s.messages
+}
+
+func (s *redisBusSubscription) Close() error {
+	return s.pubsub.Close()
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// historyKey is the Redis key under which a Room's message log is stored,
+// as a list ordered oldest-first.
+func historyKey(roomID RoomID) string {
+	return fmt.Sprintf("room:%s:history", roomID)
+}
+
+// msgIDKey is the Redis key backing NextMessageID's INCR counter. Sharing
+// this counter across every node of a federated Room is what keeps message
+// IDs strictly increasing room-wide instead of colliding per node.
+func msgIDKey(roomID RoomID) string {
+	return fmt.Sprintf("room:%s:msgid", roomID)
+}
+
+// maxHistoryLen caps how many messages are retained per room. Append trims
+// the list to this length so both storage and the cost of a History call
+// stay bounded no matter how long a room has been running.
+const maxHistoryLen = 1000
+
+// redisHistoryStore is a HistoryStore backed by a Redis list, shared across
+// every app instance hosting the same Room.
+type redisHistoryStore struct {
+	client *redis.Client
+}
+
+// NewRedisHistoryStore returns a HistoryStore backed by client.
+func NewRedisHistoryStore(client *redis.Client) HistoryStore {
+	return &redisHistoryStore{client: client}
+}
+
+func (s *redisHistoryStore) NextMessageID(ctx context.Context, roomID RoomID) (uint64, error) {
+	id, err := s.client.Incr(ctx, msgIDKey(roomID)).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "redisHistoryStore: INCR")
+	}
+	return uint64(id), nil
+}
+
+func (s *redisHistoryStore) Append(ctx context.Context, roomID RoomID, msg *outgoingMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "redisHistoryStore: marshal outgoingMessage")
+	}
+	key := historyKey(roomID)
+	if err := s.client.RPush(ctx, key, b).Err(); err != nil {
+		return errors.Wrap(err, "redisHistoryStore: RPush")
+	}
+	if err := s.client.LTrim(ctx, key, -maxHistoryLen, -1).Err(); err != nil {
+		return errors.Wrap(err, "redisHistoryStore: LTrim")
+	}
+	return nil
+}
+
+func (s *redisHistoryStore) History(ctx context.Context, roomID RoomID, limit int, beforeID uint64) ([]*outgoingMessage, error) {
+	// the list is trimmed to maxHistoryLen by Append, so this never fetches
+	// more than that regardless of how long the room has been running
+	raw, err := s.client.LRange(ctx, historyKey(roomID), -maxHistoryLen, -1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redisHistoryStore: LRange")
+	}
+
+	log := make([]*outgoingMessage, 0, len(raw))
+	for _, r := range raw {
+		msg := &outgoingMessage{}
+		if err := json.Unmarshal([]byte(r), msg); err != nil {
+			return nil, errors.Wrap(err, "redisHistoryStore: unmarshal outgoingMessage")
+		}
+		if beforeID > 0 && msg.ID >= beforeID {
+			continue
+		}
+		log = append(log, msg)
+	}
+
+	if limit <= 0 || limit > len(log) {
+		limit = len(log)
+	}
+	return log[len(log)-limit:], nil
+}
@@ -4,6 +4,7 @@ package app
 // Rooms are managed by a RoomService
 
 import (
+	"context"
 	"log"
 	"runtime/debug"
 	"time"
@@ -14,6 +15,61 @@ import (
 // RoomID identifies a *Room.
 type RoomID string
 
+// DuplicatePolicy controls what happens when a Client attempts to Register
+// with the same ID as a Client already in the Room.
+type DuplicatePolicy int
+
+const (
+	// DuplicatePolicyReject rejects the new Client with ErrNickInUse,
+	// leaving the existing Client in place.
+	DuplicatePolicyReject DuplicatePolicy = iota
+	// DuplicatePolicyReplace closes the existing Client and admits the new
+	// one. This is the behavior the Room used to have unconditionally.
+	DuplicatePolicyReplace
+)
+
+// RoomOptions configures admission behavior for a Room. The zero value
+// means no capacity limit and DuplicatePolicyReject, so a duplicate ID is
+// refused unless DuplicatePolicyReplace is set explicitly.
+type RoomOptions struct {
+	// MaxClients caps the number of Clients that may be registered at
+	// once. Zero means unlimited.
+	MaxClients int
+	// DuplicatePolicy decides what happens when a Client registers with an
+	// ID that is already in use in the Room.
+	DuplicatePolicy DuplicatePolicy
+	// SlowClientPolicy decides what happens when a Client's outbox is full
+	// at broadcast time. Zero value is SlowClientPolicyDropOldest.
+	SlowClientPolicy SlowClientPolicy
+	// MaxConsecutiveDrops is the number of consecutive dropped messages
+	// that triggers a disconnect under SlowClientPolicyDisconnect. Zero
+	// means defaultMaxConsecutiveDrops.
+	MaxConsecutiveDrops int
+	// BackpressureDeadline bounds how long broadcast() waits for room in a
+	// Client's outbox under SlowClientPolicyBackpressure. Zero means
+	// defaultBackpressureDeadline.
+	BackpressureDeadline time.Duration
+	// Bus, if set, federates this Room with the same logical Room hosted
+	// by other app instances.
+	Bus MessageBus
+	// NodeID identifies this app instance on Bus, so a Room can recognize
+	// and ignore its own published messages coming back from the bus.
+	NodeID string
+}
+
+// ErrRoomFull is returned from Register when the Room already holds
+// RoomOptions.MaxClients Clients.
+var ErrRoomFull = errors.New("room: room is full")
+
+// ErrNickInUse is returned from Register when a Client attempts to join
+// with an ID already held by a Client in the Room and the Room's
+// DuplicatePolicy is DuplicatePolicyReject.
+var ErrNickInUse = errors.New("room: client id already in use")
+
+// ErrRoomClosed is returned from Register when the Room has already
+// finished shutting down (see Close) and can no longer admit Clients.
+var ErrRoomClosed = errors.New("room: room is closed")
+
 // Room connects different Clients to one another. Messages incoming from
 // Clients using Broadcast(incomingMessage) are sent to all other Clients in
 // the Room at that time. Clients are registered in a Room using
@@ -21,29 +77,87 @@ type RoomID string
 type Room struct {
 	// Identifier of room
 	id RoomID
-	// Registered clients.
-	clients map[*Client]bool
+	// Options governing admission to the room.
+	opts RoomOptions
+	// HistoryStore records broadcast messages so they can be replayed to
+	// Clients that join later. Defaults to an in-memory store.
+	HistoryStore HistoryStore
+	// HistorySize is the number of past messages replayed to a Client on
+	// join. Zero disables replay.
+	HistorySize int
+	// fallbackMsgID is a monotonic counter assigned to each outgoingMessage
+	// when HistoryStore is nil or its NextMessageID fails. Only ever touched
+	// from the Run goroutine. Otherwise NextMessageID is used instead: a
+	// federated Room's HistoryStore is shared Redis state across every
+	// node hosting it, and only a shared, centrally-coordinated counter
+	// can hand out IDs that stay strictly increasing room-wide.
+	fallbackMsgID uint64
+	// topic is the Room's current topic, set via the "/topic" Command.
+	topic string
+	// Registered clients, keyed by the Client they wrap.
+	clients map[*Client]*Member
+	// consecutiveDrops counts, per Client, how many broadcasts in a row
+	// failed to deliver. Used by SlowClientPolicyDisconnect.
+	consecutiveDrops map[*Client]int
+	// stats backs Stats(); see roomStats for why it's atomic.
+	stats roomStats
+	// bus, if set, federates this Room with its counterpart on other
+	// nodes. nodeID tags messages this node publishes, so its own
+	// subscription can recognize and drop them instead of looping.
+	bus    MessageBus
+	nodeID string
+	// remote carries already-formed outgoingMessages received from bus,
+	// to be delivered to local clients without being re-published.
+	remote chan *outgoingMessage
 	// Inbound messages from clients.
 	broadcast chan *incomingMessage
 	// Register requests from clients.
-	register chan *Client
+	register chan *registerRequest
 	// Unregister requests from clients.
 	unregister chan *Client
+	// shutdown requests a cooperative close of the Room, carrying the
+	// reason reported to Clients.
+	shutdown chan string
 	// done chan closed when room exits
 	done chan struct{}
 	// panic chan only used for tests
 	panic chan struct{}
 }
 
-func newRoom(id RoomID) *Room {
+// shutdownDrainTimeout is how long closeRoom keeps delivering broadcasts
+// before disconnecting Clients. closeRoom always waits this long, even
+// when nothing is queued.
+const shutdownDrainTimeout = 2 * time.Second
+
+// roomIOTimeout bounds calls out to HistoryStore and MessageBus made from
+// the Run goroutine. Without it, a slow or hung Redis stalls register()
+// and broadcast() for every Client in the Room - the same class of
+// problem SlowClientPolicy solves for individual Clients.
+const roomIOTimeout = 500 * time.Millisecond
+
+// registerRequest pairs a Client wanting to join the Room with an ack
+// channel that Register uses to report back whether admission succeeded.
+type registerRequest struct {
+	client *Client
+	ack    chan error
+}
+
+func newRoom(id RoomID, opts RoomOptions) *Room {
 	return &Room{
-		id:         id,
-		broadcast:  make(chan *incomingMessage),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-		done:       make(chan struct{}),
-		panic:      make(chan struct{}),
+		id:               id,
+		opts:             opts,
+		HistoryStore:     NewMemoryHistoryStore(),
+		broadcast:        make(chan *incomingMessage),
+		register:         make(chan *registerRequest),
+		unregister:       make(chan *Client),
+		shutdown:         make(chan string),
+		clients:          make(map[*Client]*Member),
+		consecutiveDrops: make(map[*Client]int),
+		bus:              opts.Bus,
+		nodeID:           opts.NodeID,
+		remote:           make(chan *outgoingMessage),
+		done:             make(chan struct{}),
+		panic:            make(chan struct{}),
 	}
 }
 
@@ -57,13 +171,12 @@ func (r *Room) Run() {
 				"RoomPanic: Recovered panic in room.Run; closing room.\nRoomID: %s\nError: %s\nStack: %s",
 				string(r.id),
 				e,
-				debug.Stack()
+				debug.Stack(),
 			)
 
-			// close all Clients' connections
-			for client := range r.clients {
-				client.Close()
-			}
+			// let Clients know why they were disconnected via the same
+			// path a cooperative Close uses
+			closeRoom(r, "the room encountered an internal error and was closed")
 		}
 
 		// close done chan; this signals the RoomService to remove Room from its
@@ -71,10 +184,22 @@ func (r *Room) Run() {
 		close(r.done)
 	}()
 
+	if r.bus != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), roomIOTimeout)
+		sub, err := r.bus.Subscribe(ctx, r.id)
+		cancel()
+		if err != nil {
+			log.Printf("RoomBusError: failed to subscribe to message bus.\nRoomID: %s\nError: %s", string(r.id), err)
+		} else {
+			defer sub.Close()
+			go relayBusMessages(r, sub)
+		}
+	}
+
 	for {
 		select {
-		case client := <-r.register:
-			register(r, client)
+		case req := <-r.register:
+			req.ack <- register(r, req.client)
 
 		case client := <-r.unregister:
 			// if Room is empty after removing Client, unregister returns true;
@@ -85,8 +210,18 @@ func (r *Room) Run() {
 			}
 
 		case msg := <-r.broadcast:
+			if dispatchCommand(r, msg) {
+				continue
+			}
 			broadcast(r, msg)
 
+		case msg := <-r.remote:
+			deliverRemote(r, msg)
+
+		case reason := <-r.shutdown:
+			closeRoom(r, reason)
+			return
+
 		case <-r.panic:
 			// this is only used in tests to make sure that Room recovers in case of
 			// a panic
@@ -95,23 +230,54 @@ func (r *Room) Run() {
 	}
 }
 
-func register(r *Room, client *Client) {
+func register(r *Room, client *Client) error {
 	// check to see if there is already a client with same ClientID in this
 	// room
 	for c := range r.clients {
 		if c.id == client.id {
-			// if so, close that client's channel and remove client
+			if r.opts.DuplicatePolicy == DuplicatePolicyReject {
+				return ErrNickInUse
+			}
+			// DuplicatePolicyReplace: close the existing client's channel
+			// and remove it
 			delete(r.clients, c)
+			delete(r.consecutiveDrops, c)
 			c.Close()
 		}
 	}
+
+	if r.opts.MaxClients > 0 && len(r.clients) >= r.opts.MaxClients {
+		return ErrRoomFull
+	}
+
+	// replay recent history to the newly registered client before
+	// announcing its arrival, so it sees context for the conversation it's
+	// joining
+	if r.HistorySize > 0 && r.HistoryStore != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), roomIOTimeout)
+		msgs, err := r.HistoryStore.History(ctx, r.id, r.HistorySize, 0)
+		cancel()
+		if err != nil {
+			log.Printf("RoomHistoryError: failed to fetch history for replay.\nRoomID: %s\nError: %s", string(r.id), err)
+		}
+		for _, msg := range msgs {
+			client.Send(msg)
+		}
+	}
+
 	// add newly registered client
-	r.clients[client] = true
+	r.clients[client] = newMember(client)
+
+	if r.topic != "" {
+		client.Send(&outgoingMessage{Room: r.id, MsgType: messageTypes.Topic, Content: r.topic, SentAt: time.Now()})
+	}
 
 	// broadcase message to other Clients that Client joined
 	go func() {
 		r.broadcast <- &incomingMessage{from: client, msgType: messageTypes.Joined, sendBackToFrom: true}
 	}()
+
+	return nil
 }
 
 func unregister(r *Room, client *Client) (exit bool) {
@@ -119,6 +285,7 @@ func unregister(r *Room, client *Client) (exit bool) {
 	if _, ok := r.clients[client]; ok {
 		// delete from room and close client's send channel.
 		delete(r.clients, client)
+		delete(r.consecutiveDrops, client)
 		client.Close()
 
 		// if room is empty, exit
@@ -132,27 +299,140 @@ func unregister(r *Room, client *Client) (exit bool) {
 	return
 }
 
+// nextMessageID allocates the ID for the next outgoingMessage r will
+// broadcast. When r has a HistoryStore, IDs come from it: HistoryStore
+// implementations are required to hand out strictly increasing IDs across
+// every node sharing them, which is the only way a federated Room's
+// multiple nodes avoid assigning colliding IDs into the same shared log.
+// Falls back to a process-local counter when there is no HistoryStore, or
+// when its NextMessageID returns an error; IDs from that counter are not
+// coordinated with the ones the HistoryStore hands out.
+func nextMessageID(r *Room) uint64 {
+	if r.HistoryStore != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), roomIOTimeout)
+		id, err := r.HistoryStore.NextMessageID(ctx, r.id)
+		cancel()
+		if err == nil {
+			return id
+		}
+		log.Printf("RoomHistoryError: failed to allocate message ID, falling back to local counter.\nRoomID: %s\nError: %s", string(r.id), err)
+	}
+
+	r.fallbackMsgID++
+	return r.fallbackMsgID
+}
+
 func broadcast(r *Room, msg *incomingMessage) {
+	// muted members' messages never reach the rest of the room, and never
+	// enter history
+	if member, ok := r.clients[msg.from]; ok && member.Muted() {
+		return
+	}
+
+	id := nextMessageID(r)
+
 	// translate *incomingMessage to *outgoingMessage
 	outgoingMsg := &outgoingMessage{
-		Room:    r.id,
-		From:    msg.from.id,
-		MsgType: msg.msgType,
-		Content: msg.content,
-		SentAt:  time.Now(),
+		ID:         id,
+		Room:       r.id,
+		From:       msg.from.id,
+		MsgType:    msg.msgType,
+		Content:    msg.content,
+		SentAt:     time.Now(),
+		OriginNode: r.nodeID,
+	}
+
+	if r.HistoryStore != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), roomIOTimeout)
+		err := r.HistoryStore.Append(ctx, r.id, outgoingMsg)
+		cancel()
+		if err != nil {
+			log.Printf("RoomHistoryError: failed to append to history.\nRoomID: %s\nError: %s", string(r.id), err)
+		}
+	}
+
+	if r.bus != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), roomIOTimeout)
+		err := r.bus.Publish(ctx, r.id, outgoingMsg)
+		cancel()
+		if err != nil {
+			log.Printf("RoomBusError: failed to publish to message bus.\nRoomID: %s\nError: %s", string(r.id), err)
+		}
 	}
 
 	for client := range r.clients {
 		if client.id != msg.from.id || msg.sendBackToFrom {
-			successful := client.Send(outgoingMsg)
-			// client's send channel buffer is full. something has probably gone
-			// horribly wrong; remove client from room
-			if !successful {
-				delete(r.clients, client)
-				client.Close()
+			deliver(r, client, outgoingMsg)
+		}
+	}
+}
+
+// deliverRemote sends a message published by another node's Room to every
+// locally registered Client. It does not touch HistoryStore or the bus -
+// the node that originated the message already did both.
+func deliverRemote(r *Room, msg *outgoingMessage) {
+	for client := range r.clients {
+		deliver(r, client, msg)
+	}
+}
+
+// relayBusMessages reads messages published to r's bus topic and feeds
+// them to r.remote, dropping messages this same node published so they
+// aren't delivered twice.
+func relayBusMessages(r *Room, sub BusSubscription) {
+	for msg := range sub.Messages() {
+		if msg.OriginNode == r.nodeID {
+			continue
+		}
+		select {
+		case r.remote <- msg:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// closeRoom first delivers broadcasts that arrive within
+// shutdownDrainTimeout (so in-flight chat isn't lost under the closing
+// announcement), then notifies every Member why the Room is closing and
+// disconnects every Client. It is the single
+// path used both by a cooperative Room.Close and by panic recovery, so
+// Clients always learn why they were disconnected.
+func closeRoom(r *Room, reason string) {
+	deadline := time.After(shutdownDrainTimeout)
+drain:
+	for {
+		select {
+		case msg := <-r.broadcast:
+			if !dispatchCommand(r, msg) {
+				broadcast(r, msg)
 			}
+		case <-deadline:
+			break drain
 		}
 	}
+
+	closedMsg := &outgoingMessage{
+		Room:    r.id,
+		MsgType: messageTypes.RoomClosed,
+		Content: reason,
+		SentAt:  time.Now(),
+	}
+	for client := range r.clients {
+		client.Send(closedMsg)
+		client.Close()
+	}
+}
+
+// Close cooperatively shuts down the Room: every Member is sent a
+// RoomClosed message carrying reason before their connections are closed.
+// It blocks until the Room has finished closing.
+func (r *Room) Close(reason string) {
+	select {
+	case r.shutdown <- reason:
+	case <-r.done:
+	}
+	<-r.done
 }
 
 // Done returns a channel that sends an empty struct when a Room is closed.
@@ -161,18 +441,47 @@ func (r *Room) Done() <-chan struct{} {
 	return r.done
 }
 
-// Register registers a Client as being in a Room.
-func (r *Room) Register(client *Client) {
-	r.register <- client
+// Register registers a Client as being in a Room. It blocks until the Room
+// has admitted or rejected the Client, returning ErrRoomFull or
+// ErrNickInUse if admission was refused, or ErrRoomClosed if the Room has
+// already finished shutting down.
+func (r *Room) Register(client *Client) error {
+	ack := make(chan error, 1)
+	select {
+	case r.register <- &registerRequest{client: client, ack: ack}:
+		return <-ack
+	case <-r.done:
+		return ErrRoomClosed
+	}
 }
 
-// Unregister removes a Client as being in a Room.
+// Unregister removes a Client as being in a Room. It is a no-op if the
+// Room has already finished shutting down.
 func (r *Room) Unregister(client *Client) {
-	r.unregister <- client
+	select {
+	case r.unregister <- client:
+	case <-r.done:
+	}
 }
 
 // Broadcast sends an incomingMessage to all other Clients than the one
-// who is broadcasting the message.
+// who is broadcasting the message. It is a no-op if the Room has already
+// finished shutting down.
 func (r *Room) Broadcast(msg *incomingMessage) {
-	r.broadcast <- msg
+	select {
+	case r.broadcast <- msg:
+	case <-r.done:
+	}
+}
+
+// History returns up to limit past messages broadcast in the Room, oldest
+// first. If beforeID is non-zero, only messages with an ID less than
+// beforeID are returned, so callers can page backwards through the log by
+// passing the ID of the oldest message they already have. A limit of zero
+// or less returns every retained message.
+func (r *Room) History(ctx context.Context, limit int, beforeID uint64) ([]*outgoingMessage, error) {
+	if r.HistoryStore == nil {
+		return nil, nil
+	}
+	return r.HistoryStore.History(ctx, r.id, limit, beforeID)
 }
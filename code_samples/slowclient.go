@@ -0,0 +1,106 @@
+package app
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SlowClientPolicy controls what a Room does when a Client's outbox is
+// full and a new message can't be delivered to it without blocking the
+// Room's single goroutine.
+type SlowClientPolicy int
+
+const (
+	// SlowClientPolicyDropOldest discards the oldest undelivered message in
+	// the Client's outbox to make room for the new one.
+	SlowClientPolicyDropOldest SlowClientPolicy = iota
+	// SlowClientPolicyDropNewest discards the new message, leaving the
+	// Client's outbox as-is.
+	SlowClientPolicyDropNewest
+	// SlowClientPolicyDisconnect drops the new message and, once a Client
+	// has failed to receive RoomOptions.MaxConsecutiveDrops messages in a
+	// row, disconnects it.
+	SlowClientPolicyDisconnect
+	// SlowClientPolicyBackpressure waits up to
+	// RoomOptions.BackpressureDeadline for room in the Client's outbox
+	// before falling back to dropping the message.
+	SlowClientPolicyBackpressure
+)
+
+// defaultMaxConsecutiveDrops is used by SlowClientPolicyDisconnect when
+// RoomOptions.MaxConsecutiveDrops is unset.
+const defaultMaxConsecutiveDrops = 5
+
+// RoomStats is a point-in-time snapshot of a Room's delivery metrics. It is
+// safe to read from any goroutine.
+type RoomStats struct {
+	MessagesDroppedTotal       uint64
+	SlowClientDisconnectsTotal uint64
+}
+
+// roomStats holds the counters backing RoomStats. Its fields are only ever
+// mutated from the Room's Run goroutine but are read from Stats() by
+// arbitrary callers, so they're updated with atomic operations.
+type roomStats struct {
+	messagesDroppedTotal       uint64
+	slowClientDisconnectsTotal uint64
+}
+
+// Stats returns a snapshot of r's delivery metrics.
+func (r *Room) Stats() RoomStats {
+	return RoomStats{
+		MessagesDroppedTotal:       atomic.LoadUint64(&r.stats.messagesDroppedTotal),
+		SlowClientDisconnectsTotal: atomic.LoadUint64(&r.stats.slowClientDisconnectsTotal),
+	}
+}
+
+// deliver sends msg to client, applying r's SlowClientPolicy if client's
+// outbox is full. Unlike the old unconditional close-on-full behavior,
+// this lets transient slowness be absorbed or tuned instead of always
+// being treated as client failure.
+func deliver(r *Room, client *Client, msg *outgoingMessage) {
+	if client.Send(msg) {
+		delete(r.consecutiveDrops, client)
+		return
+	}
+
+	switch r.opts.SlowClientPolicy {
+	case SlowClientPolicyDropOldest:
+		client.DropOldestAndSend(msg)
+		atomic.AddUint64(&r.stats.messagesDroppedTotal, 1)
+
+	case SlowClientPolicyBackpressure:
+		deadline := r.opts.BackpressureDeadline
+		if deadline <= 0 {
+			deadline = defaultBackpressureDeadline
+		}
+		select {
+		case client.outbox <- msg:
+		case <-time.After(deadline):
+			atomic.AddUint64(&r.stats.messagesDroppedTotal, 1)
+		}
+
+	case SlowClientPolicyDisconnect:
+		atomic.AddUint64(&r.stats.messagesDroppedTotal, 1)
+		r.consecutiveDrops[client]++
+
+		max := r.opts.MaxConsecutiveDrops
+		if max <= 0 {
+			max = defaultMaxConsecutiveDrops
+		}
+		if r.consecutiveDrops[client] >= max {
+			atomic.AddUint64(&r.stats.slowClientDisconnectsTotal, 1)
+			// route through r.unregister, same as a normal disconnect, so
+			// the room still gets the Left broadcast and the room-empty
+			// exit check in unregister() still runs
+			go func() { r.unregister <- client }()
+		}
+
+	default: // SlowClientPolicyDropNewest
+		atomic.AddUint64(&r.stats.messagesDroppedTotal, 1)
+	}
+}
+
+// defaultBackpressureDeadline is used by SlowClientPolicyBackpressure when
+// RoomOptions.BackpressureDeadline is unset.
+const defaultBackpressureDeadline = 50 * time.Millisecond